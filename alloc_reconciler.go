@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const defaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+// podResourcesReconciler detects freed shards on resourceManager's behalf.
+// The device plugin v1beta1 API only ever calls Allocate; it has no
+// "container terminated" callback to call NotifyFreed from. Instead, this
+// polls the kubelet's PodResources API on an interval and calls NotifyFreed
+// for any fake ID that was allocated on a previous poll but is no longer
+// claimed by any pod.
+type podResourcesReconciler struct {
+	resourceName    string
+	resourceManager ResourceManager
+	interval        time.Duration
+
+	known map[string]bool
+}
+
+func newPodResourcesReconciler(resourceName string, manager ResourceManager, interval time.Duration) *podResourcesReconciler {
+	return &podResourcesReconciler{
+		resourceName:    resourceName,
+		resourceManager: manager,
+		interval:        interval,
+		known:           map[string]bool{},
+	}
+}
+
+// Run polls until stop is closed.
+func (r *podResourcesReconciler) Run(stop <-chan interface{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.reconcileOnce()
+		}
+	}
+}
+
+func (r *podResourcesReconciler) reconcileOnce() {
+	live, err := r.listAllocatedIDs()
+	if err != nil {
+		log.Printf("Warning: could not reach the kubelet's PodResources API to reconcile freed shards: %v\n", err)
+		return
+	}
+
+	for id := range r.known {
+		if live[id] {
+			continue
+		}
+		r.resourceManager.NotifyFreed(id)
+		delete(r.known, id)
+	}
+	for id := range live {
+		r.known[id] = true
+	}
+}
+
+// listAllocatedIDs returns every fake device ID for r.resourceName that the
+// kubelet currently reports as allocated to a running pod.
+func (r *podResourcesReconciler) listAllocatedIDs() (map[string]bool, error) {
+	conn, err := dial(defaultPodResourcesSocket, connectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[string]bool{}
+	for _, pod := range resp.PodResources {
+		for _, c := range pod.Containers {
+			for _, dev := range c.Devices {
+				if dev.ResourceName != r.resourceName {
+					continue
+				}
+				for _, id := range dev.DeviceIds {
+					live[id] = true
+				}
+			}
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// controlNodes are shared across every GPU on the host and are mounted
+// alongside each device's own /dev/nvidiaN node, the same way LXD's gpu
+// device implementation pulls in nvidiactl/nvidia-uvm for CUDA workloads.
+var controlNodes = []string{
+	"/dev/nvidiactl",
+	"/dev/nvidia-uvm",
+	"/dev/nvidia-uvm-tools",
+	"/dev/nvidia-modeset",
+}
+
+// resolveDeviceNodes returns every device node that backs d: its /dev/nvidiaN
+// character device, the host's shared NVIDIA control nodes, and any DRM
+// render/card nodes under /dev/dri whose PCI address matches d's. Allocate
+// mounts all of these into the container so that Vulkan/OpenGL/EGL contexts
+// work, not just CUDA.
+func resolveDeviceNodes(d *nvmlDevice) []string {
+	var nodes []string
+
+	if d.Path != "" {
+		nodes = append(nodes, d.Path)
+	}
+
+	for _, node := range controlNodes {
+		if _, err := os.Stat(node); err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	nodes = append(nodes, drmNodesForPCIBusID(d.PCIBusID)...)
+
+	return nodes
+}
+
+// drmNodesForPCIBusID walks /dev/dri and returns the card/render nodes whose
+// backing PCI device matches busID, resolved via the /sys/class/drm/<node>/device
+// symlink the kernel exposes for every DRM node.
+func drmNodesForPCIBusID(busID string) []string {
+	return drmNodesForPCIBusIDIn("/dev/dri", "/sys/class/drm", busID)
+}
+
+// drmNodesForPCIBusIDIn is drmNodesForPCIBusID with the /dev/dri and
+// /sys/class/drm roots taken as parameters, so tests can point it at a
+// fixture directory instead of the real host's.
+func drmNodesForPCIBusIDIn(devDRIDir, sysClassDRMDir, busID string) []string {
+	if busID == "" {
+		return nil
+	}
+	busID = strings.ToLower(busID)
+
+	entries, err := ioutil.ReadDir(devDRIDir)
+	if err != nil {
+		return nil
+	}
+
+	var nodes []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "card") && !strings.HasPrefix(name, "renderD") {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(sysClassDRMDir, name, "device"))
+		if err != nil {
+			continue
+		}
+
+		if strings.HasSuffix(strings.ToLower(target), busID) {
+			node := filepath.Join(devDRIDir, name)
+			log.Printf("Matched DRM node %s to PCI bus %s\n", node, busID)
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
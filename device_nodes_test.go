@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// drmFixture builds a fake /dev/dri + /sys/class/drm tree under t.TempDir():
+// one DRM node per entry in nodes, which maps node name to PCI bus ID.
+func drmFixture(t *testing.T, nodes map[string]string) (devDRIDir, sysClassDRMDir string) {
+	t.Helper()
+	root := t.TempDir()
+	devDRIDir = filepath.Join(root, "dev", "dri")
+	sysClassDRMDir = filepath.Join(root, "sys", "class", "drm")
+
+	for name, busID := range nodes {
+		if err := os.MkdirAll(devDRIDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(devDRIDir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		deviceDir := filepath.Join(sysClassDRMDir, name)
+		if err := os.MkdirAll(deviceDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../../../devices/pci0000:00/"+busID, filepath.Join(deviceDir, "device")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return devDRIDir, sysClassDRMDir
+}
+
+func TestDrmNodesForPCIBusIDMatchesCardAndRender(t *testing.T) {
+	devDRIDir, sysClassDRMDir := drmFixture(t, map[string]string{
+		"card0":      "0000:01:00.0",
+		"renderD128": "0000:01:00.0",
+		"card1":      "0000:02:00.0",
+	})
+
+	got := drmNodesForPCIBusIDIn(devDRIDir, sysClassDRMDir, "0000:01:00.0")
+	sort.Strings(got)
+
+	want := []string{
+		filepath.Join(devDRIDir, "card0"),
+		filepath.Join(devDRIDir, "renderD128"),
+	}
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("drmNodesForPCIBusIDIn(...) = %v, want %v", got, want)
+	}
+}
+
+func TestDrmNodesForPCIBusIDEmptyBusID(t *testing.T) {
+	devDRIDir, sysClassDRMDir := drmFixture(t, map[string]string{"card0": "0000:01:00.0"})
+
+	if got := drmNodesForPCIBusIDIn(devDRIDir, sysClassDRMDir, ""); got != nil {
+		t.Errorf("drmNodesForPCIBusIDIn(..., \"\") = %v, want nil", got)
+	}
+}
+
+func TestDrmNodesForPCIBusIDNoMatch(t *testing.T) {
+	devDRIDir, sysClassDRMDir := drmFixture(t, map[string]string{"card0": "0000:01:00.0"})
+
+	if got := drmNodesForPCIBusIDIn(devDRIDir, sysClassDRMDir, "0000:ff:00.0"); got != nil {
+		t.Errorf("drmNodesForPCIBusIDIn(..., unmatched busID) = %v, want nil", got)
+	}
+}
+
+func TestResolveDeviceNodesIncludesDevicePath(t *testing.T) {
+	d := &nvmlDevice{Path: "/dev/nvidia0"}
+
+	got := resolveDeviceNodes(d)
+	if len(got) == 0 || got[0] != "/dev/nvidia0" {
+		t.Errorf("resolveDeviceNodes() = %v, want it to start with d.Path", got)
+	}
+}
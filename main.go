@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	envResourceName = "DP_RESOURCE_NAME"
+
+	defaultResourceName = "nvidia.com/gpu"
+
+	podResourcesReconcileInterval = 30 * time.Second
+)
+
+func main() {
+	log.Println("Starting the NVIDIA device plugin")
+
+	resourceName := os.Getenv(envResourceName)
+	if resourceName == "" {
+		resourceName = defaultResourceName
+	}
+
+	manager := NewGpuDeviceManager(false)
+
+	stop := make(chan interface{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	go NewMetricsServer().Run(stop)
+
+	if err := shardConfigInstance().ListenControlSocket(stop); err != nil {
+		log.Printf("Warning: shard control socket did not start: %v\n", err)
+	}
+
+	go newPodResourcesReconciler(resourceName, manager, podResourcesReconcileInterval).Run(stop)
+
+	socket := filepath.Join(pluginapi.DevicePluginPath, strings.ReplaceAll(resourceName, "/", "-")+".sock")
+	plugin := NewNvidiaDevicePlugin(resourceName, manager, socket)
+
+	if err := plugin.Start(); err != nil {
+		log.Fatalf("Fatal: could not start device plugin for %s: %v\n", resourceName, err)
+	}
+
+	<-sigs
+	log.Println("Received signal, shutting down")
+	close(stop)
+	plugin.Stop()
+}
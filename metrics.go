@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envMetricsBindAddress  = "DP_METRICS_BIND_ADDRESS"
+	envMetricsPollInterval = "DP_METRICS_POLL_SECONDS"
+
+	defaultMetricsBindAddress  = ":9400"
+	defaultMetricsPollInterval = 30
+)
+
+// MetricsServer polls NVML on an interval and serves the results in
+// Prometheus text exposition format.
+type MetricsServer struct {
+	bindAddress  string
+	pollInterval time.Duration
+
+	mu      sync.RWMutex
+	payload []byte
+}
+
+// NewMetricsServer returns a MetricsServer configured from the
+// DP_METRICS_BIND_ADDRESS and DP_METRICS_POLL_SECONDS environment variables,
+// falling back to sane defaults when they are unset.
+func NewMetricsServer() *MetricsServer {
+	bindAddress := os.Getenv(envMetricsBindAddress)
+	if bindAddress == "" {
+		bindAddress = defaultMetricsBindAddress
+	}
+
+	pollInterval := defaultMetricsPollInterval
+	if raw := os.Getenv(envMetricsPollInterval); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v <= 0 {
+			log.Panicf("Fatal: invalid %s environment variable value: %v\n", envMetricsPollInterval, raw)
+		}
+		pollInterval = v
+	}
+
+	return &MetricsServer{
+		bindAddress:  bindAddress,
+		pollInterval: time.Duration(pollInterval) * time.Second,
+	}
+}
+
+// Run starts polling NVML and serving /metrics until stop is closed.
+func (s *MetricsServer) Run(stop <-chan interface{}) {
+	s.collect()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	server := &http.Server{Addr: s.bindAddress, Handler: mux}
+
+	go func() {
+		log.Printf("Starting metrics server on %s\n", s.bindAddress)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Warning: metrics server exited: %v\n", err)
+		}
+	}()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			server.Close()
+			return
+		case <-ticker.C:
+			s.collect()
+		}
+	}
+}
+
+func (s *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(s.payload)
+}
+
+// collect walks every NVML device (and, for MIG-enabled GPUs, every MIG
+// instance) and renders the resulting samples in Prometheus text format.
+func (s *MetricsServer) collect() {
+	n, err := backend.DeviceCount()
+	if err != nil {
+		log.Printf("Warning: failed to collect metrics: %v\n", err)
+		return
+	}
+
+	var b strings.Builder
+	writeHelp(&b)
+
+	for i := uint(0); i < n; i++ {
+		d, err := backend.NewDevice(i)
+		if err != nil {
+			log.Printf("Warning: failed to read device %d: %v\n", i, err)
+			continue
+		}
+
+		var minor uint
+		fmt.Sscanf(d.Path, "/dev/nvidia%d", &minor)
+
+		writeDeviceMetrics(&b, d, d.UUID, minor, "", "")
+
+		migEnabled, err := backend.IsMigEnabled(d)
+		if err != nil || !migEnabled {
+			continue
+		}
+
+		migs, err := backend.AllMigDevices(d)
+		if err != nil {
+			log.Printf("Warning: failed to list MIG devices for %s: %v\n", d.UUID, err)
+			continue
+		}
+		for _, mig := range migs {
+			gpu, _, _, ok := backend.ParseMigUUID(mig.UUID)
+			if !ok {
+				gpu = d.UUID
+			}
+			writeDeviceMetrics(&b, mig, gpu, minor, strconv.FormatUint(uint64(mig.GpuInstanceID), 10), strconv.FormatUint(uint64(mig.ComputeInstanceID), 10))
+		}
+	}
+
+	s.mu.Lock()
+	s.payload = []byte(b.String())
+	s.mu.Unlock()
+}
+
+func writeHelp(b *strings.Builder) {
+	metrics := []struct{ name, help, typ string }{
+		{"nvidia_gpu_utilization_ratio", "SM (compute) utilization of the GPU, in the range 0-1.", "gauge"},
+		{"nvidia_gpu_memory_utilization_ratio", "Memory controller utilization of the GPU, in the range 0-1.", "gauge"},
+		{"nvidia_gpu_memory_used_bytes", "Framebuffer memory used, in bytes.", "gauge"},
+		{"nvidia_gpu_memory_total_bytes", "Total framebuffer memory, in bytes.", "gauge"},
+		{"nvidia_gpu_temperature_celsius", "Current temperature of the GPU.", "gauge"},
+		{"nvidia_gpu_power_watts", "Current power draw of the GPU.", "gauge"},
+		{"nvidia_gpu_encoder_utilization_ratio", "Encoder utilization of the GPU, in the range 0-1.", "gauge"},
+		{"nvidia_gpu_decoder_utilization_ratio", "Decoder utilization of the GPU, in the range 0-1.", "gauge"},
+		{"nvidia_gpu_pcie_rx_bytes_per_second", "PCIe receive throughput.", "gauge"},
+		{"nvidia_gpu_pcie_tx_bytes_per_second", "PCIe transmit throughput.", "gauge"},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	}
+}
+
+func writeDeviceMetrics(b *strings.Builder, d *nvmlDevice, uuid string, minor uint, gi, ci string) {
+	status, err := backend.Status(d)
+	if err != nil {
+		log.Printf("Warning: failed to read status for %s: %v\n", uuid, err)
+		return
+	}
+
+	labels := fmt.Sprintf(`uuid="%s",minor="%d",gi="%s",ci="%s"`, uuid, minor, gi, ci)
+
+	if status.Utilization.GPU != nil {
+		fmt.Fprintf(b, "nvidia_gpu_utilization_ratio{%s} %f\n", labels, float64(*status.Utilization.GPU)/100)
+	}
+	if status.Utilization.Memory != nil {
+		fmt.Fprintf(b, "nvidia_gpu_memory_utilization_ratio{%s} %f\n", labels, float64(*status.Utilization.Memory)/100)
+	}
+	if status.Utilization.Encoder != nil {
+		fmt.Fprintf(b, "nvidia_gpu_encoder_utilization_ratio{%s} %f\n", labels, float64(*status.Utilization.Encoder)/100)
+	}
+	if status.Utilization.Decoder != nil {
+		fmt.Fprintf(b, "nvidia_gpu_decoder_utilization_ratio{%s} %f\n", labels, float64(*status.Utilization.Decoder)/100)
+	}
+	if status.MemoryUsedMiB != nil {
+		fmt.Fprintf(b, "nvidia_gpu_memory_used_bytes{%s} %d\n", labels, (*status.MemoryUsedMiB)<<20)
+	}
+	if d.MemoryMiB != 0 {
+		fmt.Fprintf(b, "nvidia_gpu_memory_total_bytes{%s} %d\n", labels, d.MemoryMiB<<20)
+	}
+	if status.TemperatureC != nil {
+		fmt.Fprintf(b, "nvidia_gpu_temperature_celsius{%s} %d\n", labels, *status.TemperatureC)
+	}
+	if status.PowerWatts != nil {
+		fmt.Fprintf(b, "nvidia_gpu_power_watts{%s} %f\n", labels, *status.PowerWatts)
+	}
+	if status.PCIThroughputRX != nil {
+		fmt.Fprintf(b, "nvidia_gpu_pcie_rx_bytes_per_second{%s} %d\n", labels, *status.PCIThroughputRX)
+	}
+	if status.PCIThroughputTX != nil {
+		fmt.Fprintf(b, "nvidia_gpu_pcie_tx_bytes_per_second{%s} %d\n", labels, *status.PCIThroughputTX)
+	}
+}
@@ -22,8 +22,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"sync"
+	"time"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -39,23 +39,36 @@ const (
 type Device struct {
 	pluginapi.Device
 	Path string
+	// Nodes holds every device node that backs this Device: the legacy
+	// /dev/nvidiaN path plus any control nodes (nvidiactl, nvidia-uvm,
+	// nvidia-modeset) and DRM nodes (/dev/dri/cardN, /dev/dri/renderDN) that
+	// share its PCI address, so that Allocate can mount all of them.
+	Nodes []string
 }
 
-// ResourceManager provides an interface for listing a set of Devices and checking health on them
+// ResourceManager provides an interface for listing a set of Devices, checking health on them,
+// and being notified when a previously unhealthy Device has recovered
 type ResourceManager interface {
 	Devices() []*Device
 	CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device)
+	RecoveredDevices() <-chan *Device
+	NotifyAllocated(fakeID string)
+	NotifyFreed(fakeID string)
 }
 
 // GpuDeviceManager implements the ResourceManager interface for full GPU devices
 type GpuDeviceManager struct {
 	skipMigEnabledGPUs bool
+	recovered          chan *Device
+	shards             *shardTracker
 }
 
 // MigDeviceManager implements the ResourceManager interface for MIG devices
 type MigDeviceManager struct {
-	strategy MigStrategy
-	resource string
+	strategy  MigStrategy
+	resource  string
+	recovered chan *Device
+	shards    *shardTracker
 }
 
 func check(err error) {
@@ -68,17 +81,49 @@ func check(err error) {
 func NewGpuDeviceManager(skipMigEnabledGPUs bool) *GpuDeviceManager {
 	return &GpuDeviceManager{
 		skipMigEnabledGPUs: skipMigEnabledGPUs,
+		recovered:          make(chan *Device),
+		shards:             newShardTracker(),
 	}
 }
 
 // NewMigDeviceManager returns a reference to a new MigDeviceManager
 func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManager {
 	return &MigDeviceManager{
-		strategy: strategy,
-		resource: resource,
+		strategy:  strategy,
+		resource:  resource,
+		recovered: make(chan *Device),
+		shards:    newShardTracker(),
 	}
 }
 
+// NotifyAllocated tells the manager that Allocate has handed fakeID to a
+// container, so a later shard resize won't revoke it out from under that
+// container. Called from NvidiaDevicePlugin.Allocate (server.go) and, for
+// the other direction, from podResourcesReconciler (alloc_reconciler.go)
+// once the kubelet's PodResources API reports the container is gone.
+func (g *GpuDeviceManager) NotifyAllocated(fakeID string) {
+	g.shards.MarkAllocated(fakeID)
+}
+
+// NotifyFreed tells the manager that fakeID's owning pod has terminated,
+// making it eligible to disappear on the next shard resize.
+func (g *GpuDeviceManager) NotifyFreed(fakeID string) {
+	g.shards.MarkFreed(fakeID)
+}
+
+// NotifyAllocated tells the manager that Allocate has handed fakeID to a
+// container, so a later shard resize won't revoke it out from under that
+// container.
+func (m *MigDeviceManager) NotifyAllocated(fakeID string) {
+	m.shards.MarkAllocated(fakeID)
+}
+
+// NotifyFreed tells the manager that fakeID's owning pod has terminated,
+// making it eligible to disappear on the next shard resize.
+func (m *MigDeviceManager) NotifyFreed(fakeID string) {
+	m.shards.MarkFreed(fakeID)
+}
+
 func setGPUMemory(raw uint) {
 	v := raw
 	gpuMemory = v
@@ -111,42 +156,45 @@ func extractRealDeviceID(fakeDeviceID string) string {
 
 // Devices returns a list of devices from the GpuDeviceManager
 func (g *GpuDeviceManager) Devices() []*Device {
-	n, err := nvml.GetDeviceCount()
+	n, err := backend.DeviceCount()
 	check(err)
 
 	var devs []*Device
-	realDevNames := map[string]uint{}
 
 	for i := uint(0); i < n; i++ {
-		// d, err := nvml.NewDeviceLite(i)
-		d, err := nvml.NewDevice(i)
+		d, err := backend.NewDevice(i)
 		check(err)
-		var id uint
 		log.Printf("Deivce %s's Path is %s\n", d.UUID, d.Path)
-		_, err = fmt.Sscanf(d.Path, "/dev/nvidia%d", &id)
-		check(err)
-		realDevNames[d.UUID] = id
 		if getGPUMemory() == uint(0) {
-			setGPUMemory(uint(*d.Memory))
+			setGPUMemory(uint(d.MemoryMiB))
 		}
 
-		migEnabled, err := d.IsMigEnabled()
+		migEnabled, err := backend.IsMigEnabled(d)
 		check(err)
 
 		if migEnabled && g.skipMigEnabledGPUs {
 			continue
 		}
 
-		reserve := getReservedMemPerGPU()
-		actual := (getGPUMemory() / 100) * (100 - reserve)
-		log.Printf("device Memory is: %d, now reserve is %d, %d can use", uint(*d.Memory), reserve, actual)
+		shardUnitMiB, reserve := shardConfigInstance().get()
+		usable := (getGPUMemory() / 100) * (100 - reserve)
+		actual := usable / shardUnitMiB
+		log.Printf("device Memory is: %d, now reserve is %d, shard unit is %d MiB, %d shard(s) available", d.MemoryMiB, reserve, shardUnitMiB, actual)
+		topology := deviceTopology(d)
+		nodes := resolveDeviceNodes(d)
+
+		var desired []string
 		for j := uint(0); j < actual; j++ {
-			fakeID := generateFakeDeviceID(d.UUID, j)
+			desired = append(desired, generateFakeDeviceID(d.UUID, j))
+		}
+		for _, fakeID := range g.shards.reconcile(d.UUID, desired) {
 			devs = append(devs, &Device{
-				Path: d.Path,
+				Path:  d.Path,
+				Nodes: nodes,
 				Device: pluginapi.Device{
-					ID:     fakeID,
-					Health: pluginapi.Healthy,
+					ID:       fakeID,
+					Health:   pluginapi.Healthy,
+					Topology: topology,
 				},
 			})
 		}
@@ -158,47 +206,56 @@ func (g *GpuDeviceManager) Devices() []*Device {
 
 // Devices returns a list of devices from the MigDeviceManager
 func (m *MigDeviceManager) Devices() []*Device {
-	n, err := nvml.GetDeviceCount()
+	n, err := backend.DeviceCount()
 	check(err)
 
 	var devs []*Device
-	realDevNames := map[string]uint{}
 
 	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDevice(i)
+		d, err := backend.NewDevice(i)
 		check(err)
-		var id uint
 		log.Printf("Deivce %s's Path is %s", d.UUID, d.Path)
-		_, err = fmt.Sscanf(d.Path, "/dev/nvidia%d", &id)
-		check(err)
-		realDevNames[d.UUID] = id
-		log.Println("# device Memory:", uint(*d.Memory))
+		log.Println("# device Memory:", d.MemoryMiB)
 		if getGPUMemory() == uint(0) {
-			setGPUMemory(uint(*d.Memory))
+			setGPUMemory(uint(d.MemoryMiB))
 		}
 
-		migEnabled, err := d.IsMigEnabled()
+		migEnabled, err := backend.IsMigEnabled(d)
 		check(err)
 
 		if !migEnabled {
 			continue
 		}
 
-		migs, err := d.GetMigDevices()
+		migs, err := backend.MigDevices(d, m.strategy, m.resource)
 		check(err)
 
-		actual := getGPUMemory() * (1 - (getReservedMemPerGPU() / 100))
+		// This reserve computation replaced getGPUMemory() * (1 - (reserve / 100)),
+		// which integer-divided reserve/100 to 0 for every reserve < 100 and so
+		// never actually reserved anything for MIG devices. Fixed here as part
+		// of switching this manager over to the shared, runtime-configurable
+		// shardConfig.
+		shardUnitMiB, reserve := shardConfigInstance().get()
+		usable := (getGPUMemory() / 100) * (100 - reserve)
+		actual := usable / shardUnitMiB
+		topology := deviceTopology(d)
+		nodes := resolveDeviceNodes(d)
 		for _, mig := range migs {
-			if !m.strategy.MatchesResource(mig, m.resource) {
-				continue
-			}
+			var desired []string
 			for j := uint(0); j < actual; j++ {
-				fakeID := generateFakeDeviceID(d.UUID, j)
+				// Fake IDs are derived from mig.UUID (each MIG instance's own
+				// UUID), not d.UUID (the parent GPU's): the latter collided
+				// across every MIG instance on the same card.
+				desired = append(desired, generateFakeDeviceID(mig.UUID, j))
+			}
+			for _, fakeID := range m.shards.reconcile(mig.UUID, desired) {
 				devs = append(devs, &Device{
-					Path: d.Path,
+					Path:  d.Path,
+					Nodes: nodes,
 					Device: pluginapi.Device{
-						ID:     fakeID,
-						Health: pluginapi.Healthy,
+						ID:       fakeID,
+						Health:   pluginapi.Healthy,
+						Topology: topology,
 					},
 				})
 			}
@@ -210,32 +267,37 @@ func (m *MigDeviceManager) Devices() []*Device {
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
 func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, unhealthy)
+	checkHealth(stop, devices, unhealthy, g.recovered)
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
 func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, unhealthy)
+	checkHealth(stop, devices, unhealthy, m.recovered)
+}
+
+// RecoveredDevices returns the channel on which Devices that have recovered from a past
+// unhealthy Xid, after DP_HEALTHCHECK_RECOVERY_SECONDS of cool-off, are emitted
+func (g *GpuDeviceManager) RecoveredDevices() <-chan *Device {
+	return g.recovered
 }
 
-func buildDevice(d *nvml.Device) *Device {
+// RecoveredDevices returns the channel on which Devices that have recovered from a past
+// unhealthy Xid, after DP_HEALTHCHECK_RECOVERY_SECONDS of cool-off, are emitted
+func (m *MigDeviceManager) RecoveredDevices() <-chan *Device {
+	return m.recovered
+}
+
+func buildDevice(d *nvmlDevice) *Device {
 	dev := Device{}
 	dev.ID = d.UUID
 	dev.Health = pluginapi.Healthy
 	dev.Path = d.Path
-	if d.CPUAffinity != nil {
-		dev.Topology = &pluginapi.TopologyInfo{
-			Nodes: []*pluginapi.NUMANode{
-				&pluginapi.NUMANode{
-					ID: int64(*(d.CPUAffinity)),
-				},
-			},
-		}
-	}
+	dev.Nodes = resolveDeviceNodes(d)
+	dev.Topology = deviceTopology(d)
 	return &dev
 }
 
-func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device, recovered chan<- *Device) {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
 		disableHealthChecks = allHealthChecks
@@ -244,17 +306,20 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		return
 	}
 
-	eventSet := nvml.NewEventSet()
-	defer nvml.DeleteEventSet(eventSet)
+	policy := newXidPolicy()
+	tracker := newUnhealthyTracker()
+
+	eventSet := backend.NewEventSet()
+	defer eventSet.Close()
 
 	for _, d := range devices {
 		id := extractRealDeviceID(d.ID)
-		gpu, _, _, err := nvml.ParseMigDeviceUUID(id)
-		if err != nil {
+		gpu, _, _, ok := backend.ParseMigUUID(id)
+		if !ok {
 			gpu = id
 		}
 
-		err = nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, gpu)
+		err := eventSet.RegisterDevice(gpu)
 		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
 			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", id, err)
 			unhealthy <- d
@@ -270,22 +335,30 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		default:
 		}
 
-		e, err := nvml.WaitForEvent(eventSet, 5000)
-		if err != nil && e.Etype != nvml.XidCriticalError {
+		if policy.recoveryCoolOff > 0 {
+			for _, d := range tracker.recoverable(devices, policy.recoveryCoolOff) {
+				log.Printf("Device=%s has seen no fatal Xid for %s, marking it healthy again.", extractRealDeviceID(d.ID), policy.recoveryCoolOff)
+				recovered <- d
+			}
+		}
+
+		e, err := eventSet.Wait(5000)
+		if err != nil {
 			continue
 		}
 
-		// FIXME: formalize the full list and document it.
-		// http://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
-		// Application errors: the GPU should still be healthy
-		if e.Edata == 31 || e.Edata == 43 || e.Edata == 45 {
+		if policy.isApplicationError(e.Xid) {
 			continue
 		}
 
-		if e.UUID == nil || len(*e.UUID) == 0 {
+		if !e.HasUUID {
+			if !policy.isFatal(e.Xid) {
+				continue
+			}
 			// All devices are unhealthy
-			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
+			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Xid)
 			for _, d := range devices {
+				tracker.markUnhealthy(d)
 				unhealthy <- d
 			}
 			continue
@@ -295,17 +368,66 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 			id := extractRealDeviceID(d.ID)
 			// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
 			// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
-			gpu, gi, ci, err := nvml.ParseMigDeviceUUID(id)
-			if err != nil {
+			gpu, gi, ci, ok := backend.ParseMigUUID(id)
+			if !ok {
 				gpu = id
 				gi = 0xFFFFFFFF
 				ci = 0xFFFFFFFF
 			}
 
-			if gpu == *e.UUID && gi == *e.GpuInstanceId && ci == *e.ComputeInstanceId {
-				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Edata, id)
+			if gpu == e.UUID && gi == e.GpuInstanceID && ci == e.ComputeInstanceID {
+				if !policy.isFatal(e.Xid) {
+					continue
+				}
+				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Xid, id)
+				tracker.markUnhealthy(d)
 				unhealthy <- d
 			}
 		}
 	}
 }
+
+// unhealthyTracker records when each Device last saw a fatal Xid, so that
+// checkHealth can offer a Device back to ListAndWatch once it has gone
+// DP_HEALTHCHECK_RECOVERY_SECONDS without a further fatal error.
+type unhealthyTracker struct {
+	mu       sync.Mutex
+	lastXid  map[string]time.Time
+	reported map[string]bool
+}
+
+func newUnhealthyTracker() *unhealthyTracker {
+	return &unhealthyTracker{
+		lastXid:  make(map[string]time.Time),
+		reported: make(map[string]bool),
+	}
+}
+
+func (t *unhealthyTracker) markUnhealthy(d *Device) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastXid[d.ID] = time.Now()
+	t.reported[d.ID] = false
+}
+
+// recoverable returns the Devices that are currently marked unhealthy, have
+// not yet been reported as recovered, and have gone at least coolOff since
+// their last fatal Xid.
+func (t *unhealthyTracker) recoverable(devices []*Device, coolOff time.Duration) []*Device {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []*Device
+	for _, d := range devices {
+		last, ok := t.lastXid[d.ID]
+		if !ok || t.reported[d.ID] {
+			continue
+		}
+		if time.Since(last) < coolOff {
+			continue
+		}
+		t.reported[d.ID] = true
+		out = append(out, d)
+	}
+	return out
+}
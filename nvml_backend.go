@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// nvmlDevice is the backend-agnostic view of a physical GPU, or of a single
+// MIG instance on one, that the rest of the plugin operates on. Keeping it
+// free of the real NVML bindings lets everything outside nvml_linux.go and
+// nvml_unsupported.go stay buildable without cgo.
+type nvmlDevice struct {
+	UUID      string
+	Path      string
+	MemoryMiB uint64
+	// NumaNodes holds every NUMA node reported for this device. A device can
+	// report more than one when its CPU affinity mask spans multiple nodes
+	// (e.g. an NVLink/NVSwitch baseboard with GPUs wired across sockets).
+	NumaNodes []int64
+	PCIBusID  string
+
+	IsMigInstance     bool
+	GpuInstanceID     uint32
+	ComputeInstanceID uint32
+
+	// handle is opaque backend-private state (e.g. the real *nvml.Device on
+	// Linux) that only the nvmlBackend implementation that created this
+	// nvmlDevice knows how to interpret.
+	handle interface{}
+}
+
+// nvmlUtilization mirrors nvml.UtilizationInfo; fields are nil when the
+// driver doesn't report that counter for a given device.
+type nvmlUtilization struct {
+	GPU     *uint
+	Memory  *uint
+	Encoder *uint
+	Decoder *uint
+}
+
+// nvmlStatus is a point-in-time snapshot of the live telemetry the metrics
+// endpoint publishes for a device.
+type nvmlStatus struct {
+	Utilization     nvmlUtilization
+	MemoryUsedMiB   *uint64
+	TemperatureC    *uint
+	PowerWatts      *float64
+	PCIThroughputRX *uint64
+	PCIThroughputTX *uint64
+}
+
+// nvmlEvent mirrors the subset of an NVML Xid critical-error event that
+// checkHealth acts on.
+type nvmlEvent struct {
+	Xid               uint64
+	UUID              string
+	HasUUID           bool
+	GpuInstanceID     uint32
+	ComputeInstanceID uint32
+}
+
+// nvmlEventSet lets checkHealth register for and wait on Xid events without
+// depending on the real NVML event APIs directly.
+type nvmlEventSet interface {
+	RegisterDevice(uuid string) error
+	Wait(timeoutMs uint) (nvmlEvent, error)
+	Close()
+}
+
+// nvmlBackend is the seam between the plugin's device listing, health
+// checking and metrics logic and NVML itself. nvml_linux.go provides the
+// real, cgo-backed implementation; nvml_unsupported.go provides a
+// zero-device stand-in for hosts where the NVIDIA bindings can't be built,
+// so the rest of the plugin (and its tests) can build and run anywhere.
+type nvmlBackend interface {
+	// DeviceCount returns the number of physical GPUs visible to NVML.
+	DeviceCount() (uint, error)
+	// NewDevice returns the physical GPU at the given index.
+	NewDevice(idx uint) (*nvmlDevice, error)
+	// IsMigEnabled reports whether MIG mode is enabled on d.
+	IsMigEnabled(d *nvmlDevice) (bool, error)
+	// MigDevices returns the MIG instances on d that match resource under
+	// strategy.
+	MigDevices(d *nvmlDevice, strategy MigStrategy, resource string) ([]*nvmlDevice, error)
+	// AllMigDevices returns every MIG instance on d, regardless of resource,
+	// for callers (like the metrics collector) that need to observe every
+	// instance rather than just the ones backing a given Kubernetes resource.
+	AllMigDevices(d *nvmlDevice) ([]*nvmlDevice, error)
+	// Status returns live utilization/memory/thermal/power telemetry for d.
+	Status(d *nvmlDevice) (*nvmlStatus, error)
+	// ParseMigUUID splits a MIG device UUID into its parent GPU UUID and
+	// GI/CI indices. ok is false when uuid names a full GPU rather than a
+	// MIG instance.
+	ParseMigUUID(uuid string) (gpu string, gi uint32, ci uint32, ok bool)
+	// NewEventSet returns a new set for registering and waiting on Xid events.
+	NewEventSet() nvmlEventSet
+}
+
+var backend nvmlBackend = newNvmlBackend()
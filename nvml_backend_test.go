@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "testing"
+
+// fakeNvmlBackend is a minimal nvmlBackend stand-in for exercising
+// GpuDeviceManager.Devices() without the real cgo bindings.
+type fakeNvmlBackend struct {
+	devices []*nvmlDevice
+}
+
+func (f *fakeNvmlBackend) DeviceCount() (uint, error) { return uint(len(f.devices)), nil }
+
+func (f *fakeNvmlBackend) NewDevice(idx uint) (*nvmlDevice, error) {
+	return f.devices[idx], nil
+}
+
+func (f *fakeNvmlBackend) IsMigEnabled(d *nvmlDevice) (bool, error) { return false, nil }
+
+func (f *fakeNvmlBackend) MigDevices(d *nvmlDevice, strategy MigStrategy, resource string) ([]*nvmlDevice, error) {
+	return nil, nil
+}
+
+func (f *fakeNvmlBackend) AllMigDevices(d *nvmlDevice) ([]*nvmlDevice, error) { return nil, nil }
+
+func (f *fakeNvmlBackend) Status(d *nvmlDevice) (*nvmlStatus, error) { return &nvmlStatus{}, nil }
+
+func (f *fakeNvmlBackend) ParseMigUUID(uuid string) (string, uint32, uint32, bool) {
+	return uuid, 0, 0, false
+}
+
+func (f *fakeNvmlBackend) NewEventSet() nvmlEventSet { return &noopEventSet{} }
+
+// withFakeBackend swaps the package-level backend for fake for the duration
+// of the test, restoring the original afterwards.
+func withFakeBackend(t *testing.T, fake nvmlBackend) {
+	t.Helper()
+	original := backend
+	backend = fake
+	t.Cleanup(func() { backend = original })
+}
+
+func TestGpuDeviceManagerDevicesUsesShardConfig(t *testing.T) {
+	t.Setenv(envReservedMemPerGPU, "50")
+	resetShardsForTest()
+	gpuMemory = 0
+	t.Cleanup(func() { gpuMemory = 0 })
+
+	withFakeBackend(t, &fakeNvmlBackend{
+		devices: []*nvmlDevice{
+			{UUID: "GPU-fake-0", Path: "/dev/nvidia0", MemoryMiB: 4000},
+		},
+	})
+	shardConfigInstance().set(1000, 50)
+
+	mgr := NewGpuDeviceManager(false)
+	devs := mgr.Devices()
+
+	if len(devs) != 2 {
+		t.Fatalf("Devices() returned %d devices, want 2 (4000 MiB GPU, 50%% reserved, 1000 MiB shards)", len(devs))
+	}
+	for _, d := range devs {
+		if extractRealDeviceID(d.ID) != "GPU-fake-0" {
+			t.Errorf("device ID %q does not derive from the fake GPU's UUID", d.ID)
+		}
+	}
+}
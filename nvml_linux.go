@@ -0,0 +1,191 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// realNvmlBackend is the nvmlBackend backed by the real NVML cgo bindings.
+type realNvmlBackend struct{}
+
+func newNvmlBackend() nvmlBackend {
+	return &realNvmlBackend{}
+}
+
+func (b *realNvmlBackend) DeviceCount() (uint, error) {
+	return nvml.GetDeviceCount()
+}
+
+func (b *realNvmlBackend) NewDevice(idx uint) (*nvmlDevice, error) {
+	d, err := nvml.NewDevice(idx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapDevice(d), nil
+}
+
+func (b *realNvmlBackend) IsMigEnabled(d *nvmlDevice) (bool, error) {
+	return realDevice(d).IsMigEnabled()
+}
+
+func (b *realNvmlBackend) MigDevices(d *nvmlDevice, strategy MigStrategy, resource string) ([]*nvmlDevice, error) {
+	migs, err := realDevice(d).GetMigDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*nvmlDevice
+	for _, mig := range migs {
+		if !strategy.MatchesResource(mig, resource) {
+			continue
+		}
+		out = append(out, wrapMigDevice(mig))
+	}
+	return out, nil
+}
+
+func (b *realNvmlBackend) AllMigDevices(d *nvmlDevice) ([]*nvmlDevice, error) {
+	migs, err := realDevice(d).GetMigDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*nvmlDevice
+	for _, mig := range migs {
+		out = append(out, wrapMigDevice(mig))
+	}
+	return out, nil
+}
+
+func (b *realNvmlBackend) Status(d *nvmlDevice) (*nvmlStatus, error) {
+	status, err := realDevice(d).Status()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &nvmlStatus{
+		Utilization: nvmlUtilization{
+			GPU:     status.Utilization.GPU,
+			Memory:  status.Utilization.Memory,
+			Encoder: status.Utilization.Encoder,
+			Decoder: status.Utilization.Decoder,
+		},
+		TemperatureC: status.Temperature,
+	}
+	if status.Power != nil {
+		watts := float64(*status.Power) / 1000
+		out.PowerWatts = &watts
+	}
+	if status.Memory.Global.Used != nil {
+		usedMiB := uint64(*status.Memory.Global.Used)
+		out.MemoryUsedMiB = &usedMiB
+	}
+	if status.PCI.ThroughputRX != nil {
+		rx := uint64(*status.PCI.ThroughputRX) << 10
+		out.PCIThroughputRX = &rx
+	}
+	if status.PCI.ThroughputTX != nil {
+		tx := uint64(*status.PCI.ThroughputTX) << 10
+		out.PCIThroughputTX = &tx
+	}
+	return out, nil
+}
+
+func (b *realNvmlBackend) ParseMigUUID(uuid string) (string, uint32, uint32, bool) {
+	gpu, gi, ci, err := nvml.ParseMigDeviceUUID(uuid)
+	if err != nil {
+		return uuid, 0, 0, false
+	}
+	return gpu, gi, ci, true
+}
+
+func (b *realNvmlBackend) NewEventSet() nvmlEventSet {
+	return &realEventSet{set: nvml.NewEventSet()}
+}
+
+type realEventSet struct {
+	set nvml.EventSet
+}
+
+func (s *realEventSet) RegisterDevice(uuid string) error {
+	return nvml.RegisterEventForDevice(s.set, nvml.XidCriticalError, uuid)
+}
+
+func (s *realEventSet) Wait(timeoutMs uint) (nvmlEvent, error) {
+	e, err := nvml.WaitForEvent(s.set, timeoutMs)
+	if err != nil && e.Etype != nvml.XidCriticalError {
+		return nvmlEvent{}, err
+	}
+
+	out := nvmlEvent{Xid: e.Edata}
+	if e.UUID != nil && len(*e.UUID) > 0 {
+		out.HasUUID = true
+		out.UUID = *e.UUID
+	}
+	if e.GpuInstanceId != nil {
+		out.GpuInstanceID = *e.GpuInstanceId
+	}
+	if e.ComputeInstanceId != nil {
+		out.ComputeInstanceID = *e.ComputeInstanceId
+	}
+	return out, nil
+}
+
+func (s *realEventSet) Close() {
+	nvml.DeleteEventSet(s.set)
+}
+
+// realDevice recovers the *nvml.Device that wrapDevice stashed in d.handle.
+func realDevice(d *nvmlDevice) *nvml.Device {
+	return d.handle.(*nvml.Device)
+}
+
+func wrapMigDevice(mig *nvml.Device) *nvmlDevice {
+	wrapped := wrapDevice(mig)
+	wrapped.IsMigInstance = true
+	wrapped.GpuInstanceID = uint32(0xFFFFFFFF)
+	wrapped.ComputeInstanceID = uint32(0xFFFFFFFF)
+	if mig.GpuInstanceId != nil {
+		wrapped.GpuInstanceID = uint32(*mig.GpuInstanceId)
+	}
+	if mig.ComputeInstanceId != nil {
+		wrapped.ComputeInstanceID = uint32(*mig.ComputeInstanceId)
+	}
+	return wrapped
+}
+
+func wrapDevice(d *nvml.Device) *nvmlDevice {
+	out := &nvmlDevice{
+		UUID:   d.UUID,
+		Path:   d.Path,
+		handle: d,
+	}
+	if d.Memory != nil {
+		out.MemoryMiB = uint64(*d.Memory)
+	}
+	if d.CPUAffinity != nil {
+		out.NumaNodes = numaNodesFromAffinityMask(uint64(*d.CPUAffinity), cpuNUMANode)
+	}
+	if d.PCI != nil {
+		out.PCIBusID = d.PCI.BusID
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+//go:build !linux || !cgo
+// +build !linux !cgo
+
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNvmlUnsupported is returned by every unsupportedNvmlBackend method that
+// takes or returns a device, and by noopEventSet.Wait: the real NVML bindings
+// require cgo and Linux, so there is nothing to back these calls with here.
+// DeviceCount instead reports zero devices with no error.
+var errNvmlUnsupported = errors.New("nvml: not supported on this platform")
+
+// unsupportedNvmlBackend is a zero-device stand-in for hosts that can't
+// build the real cgo NVML bindings (non-Linux, or cgo disabled). It lets the
+// rest of the plugin - and its tests - build and run anywhere, advertising
+// no devices rather than failing to start.
+type unsupportedNvmlBackend struct{}
+
+func newNvmlBackend() nvmlBackend {
+	return &unsupportedNvmlBackend{}
+}
+
+func (b *unsupportedNvmlBackend) DeviceCount() (uint, error) {
+	return 0, nil
+}
+
+func (b *unsupportedNvmlBackend) NewDevice(idx uint) (*nvmlDevice, error) {
+	return nil, errNvmlUnsupported
+}
+
+func (b *unsupportedNvmlBackend) IsMigEnabled(d *nvmlDevice) (bool, error) {
+	return false, errNvmlUnsupported
+}
+
+func (b *unsupportedNvmlBackend) MigDevices(d *nvmlDevice, strategy MigStrategy, resource string) ([]*nvmlDevice, error) {
+	return nil, errNvmlUnsupported
+}
+
+func (b *unsupportedNvmlBackend) AllMigDevices(d *nvmlDevice) ([]*nvmlDevice, error) {
+	return nil, errNvmlUnsupported
+}
+
+func (b *unsupportedNvmlBackend) Status(d *nvmlDevice) (*nvmlStatus, error) {
+	return nil, errNvmlUnsupported
+}
+
+func (b *unsupportedNvmlBackend) ParseMigUUID(uuid string) (string, uint32, uint32, bool) {
+	return uuid, 0, 0, false
+}
+
+func (b *unsupportedNvmlBackend) NewEventSet() nvmlEventSet {
+	return &noopEventSet{}
+}
+
+// noopEventSet never receives events: CheckHealth loops until stop is closed.
+type noopEventSet struct{}
+
+func (s *noopEventSet) RegisterDevice(uuid string) error { return nil }
+
+// Wait sleeps for timeoutMs before returning, mirroring the real backend's
+// blocking NVML call. checkHealth treats every error here as "nothing
+// happened, loop again" - without this sleep it would spin its goroutine at
+// 100% CPU on every non-cgo/non-Linux build.
+func (s *noopEventSet) Wait(timeoutMs uint) (nvmlEvent, error) {
+	time.Sleep(time.Duration(timeoutMs) * time.Millisecond)
+	return nvmlEvent{}, errNvmlUnsupported
+}
+
+func (s *noopEventSet) Close() {}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const connectionTimeout = 5 * time.Second
+
+// NvidiaDevicePlugin implements the kubelet device plugin v1beta1 gRPC
+// service for a single resource name, backed by a ResourceManager.
+type NvidiaDevicePlugin struct {
+	resourceManager ResourceManager
+	resourceName    string
+	socket          string
+
+	server        *grpc.Server
+	cachedDevices []*Device
+	health        chan *Device
+	stop          chan interface{}
+}
+
+// NewNvidiaDevicePlugin returns a plugin that advertises resourceName's
+// devices, as reported by manager, over a Unix socket at socket.
+func NewNvidiaDevicePlugin(resourceName string, manager ResourceManager, socket string) *NvidiaDevicePlugin {
+	return &NvidiaDevicePlugin{
+		resourceManager: manager,
+		resourceName:    resourceName,
+		socket:          socket,
+		health:          make(chan *Device),
+	}
+}
+
+// Start serves the gRPC endpoint, registers it with the kubelet, and starts
+// the manager's health check loop. Callers must call Stop when done.
+func (m *NvidiaDevicePlugin) Start() error {
+	m.cachedDevices = m.resourceManager.Devices()
+	m.server = grpc.NewServer()
+	m.stop = make(chan interface{})
+
+	if err := m.serve(); err != nil {
+		log.Printf("Could not start device plugin for %s: %v\n", m.resourceName, err)
+		m.Stop()
+		return err
+	}
+	log.Printf("Serving %s on %s\n", m.resourceName, m.socket)
+
+	if err := m.register(); err != nil {
+		log.Printf("Could not register device plugin for %s with the kubelet: %v\n", m.resourceName, err)
+		m.Stop()
+		return err
+	}
+	log.Printf("Registered %s with the kubelet\n", m.resourceName)
+
+	go m.resourceManager.CheckHealth(m.stop, m.cachedDevices, m.health)
+
+	return nil
+}
+
+// Stop tears down the gRPC server and removes its socket. It is safe to call
+// on a plugin that was never started or has already been stopped.
+func (m *NvidiaDevicePlugin) Stop() error {
+	if m.server == nil {
+		return nil
+	}
+	m.server.Stop()
+	if m.stop != nil {
+		close(m.stop)
+	}
+	m.server = nil
+	m.stop = nil
+	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *NvidiaDevicePlugin) serve() error {
+	os.Remove(m.socket)
+	sock, err := net.Listen("unix", m.socket)
+	if err != nil {
+		return err
+	}
+
+	pluginapi.RegisterDevicePluginServer(m.server, m)
+	go m.server.Serve(sock)
+
+	conn, err := dial(m.socket, connectionTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (m *NvidiaDevicePlugin) register() error {
+	conn, err := dial(pluginapi.KubeletSocket, connectionTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := pluginapi.NewRegistrationClient(conn)
+	_, err = client.Register(context.Background(), &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     path.Base(m.socket),
+		ResourceName: m.resourceName,
+		Options:      &pluginapi.DevicePluginOptions{},
+	})
+	return err
+}
+
+// GetDevicePluginOptions returns the options this plugin supports; this
+// plugin needs none of them.
+func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{}, nil
+}
+
+// ListAndWatch streams the current device list to the kubelet, and again
+// whenever a device's health changes, a device recovers, or the shard
+// configuration changes the set of fake IDs to advertise.
+func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: apiDevices(m.cachedDevices)}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-m.stop:
+			return nil
+
+		case d := <-m.health:
+			d.Health = pluginapi.Unhealthy
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: apiDevices(m.cachedDevices)}); err != nil {
+				return err
+			}
+
+		case d := <-m.resourceManager.RecoveredDevices():
+			d.Health = pluginapi.Healthy
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: apiDevices(m.cachedDevices)}); err != nil {
+				return err
+			}
+
+		case <-shardConfigInstance().Changed():
+			m.cachedDevices = m.resourceManager.Devices()
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: apiDevices(m.cachedDevices)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Allocate mounts every device node backing each requested fake ID into its
+// container, and tells the resource manager the ID is now in use so a later
+// shard resize won't revoke it.
+func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := &pluginapi.AllocateResponse{}
+
+	for _, req := range reqs.ContainerRequests {
+		response := &pluginapi.ContainerAllocateResponse{}
+
+		for _, id := range req.DevicesIDs {
+			dev := m.deviceForID(id)
+			if dev == nil {
+				return nil, fmt.Errorf("unknown device ID in allocate request: %s", id)
+			}
+			m.resourceManager.NotifyAllocated(id)
+
+			for _, node := range dev.Nodes {
+				response.Devices = append(response.Devices, &pluginapi.DeviceSpec{
+					HostPath:      node,
+					ContainerPath: node,
+					Permissions:   "rw",
+				})
+			}
+		}
+
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+
+	return responses, nil
+}
+
+// PreStartContainer is a no-op: this plugin has nothing to prepare before a
+// container using its devices starts.
+func (m *NvidiaDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// GetPreferredAllocation expresses no preference: any devices the kubelet
+// chooses from the available set are equally fine.
+func (m *NvidiaDevicePlugin) GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return &pluginapi.PreferredAllocationResponse{}, nil
+}
+
+func (m *NvidiaDevicePlugin) deviceForID(id string) *Device {
+	for _, d := range m.cachedDevices {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// apiDevices returns the pluginapi.Device view of devs, for ListAndWatch
+// responses.
+func apiDevices(devs []*Device) []*pluginapi.Device {
+	var out []*pluginapi.Device
+	for _, d := range devs {
+		out = append(out, &d.Device)
+	}
+	return out
+}
+
+// dial connects to the Unix socket at path, waiting up to timeout for the
+// other end to come up.
+func dial(socketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
+	return grpc.Dial(
+		socketPath,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithTimeout(timeout),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	envShardControlSocket     = "DP_SHARD_CONTROL_SOCKET"
+	defaultShardControlSocket = "/var/lib/kubelet/device-plugins/gpu-shard-control.sock"
+)
+
+// shardsVal holds the operator-tunable knobs controlling how a physical GPU's
+// memory is sliced into fake shard devices. Unlike envReservedMemPerGPU,
+// which is only read once at startup, these can be changed at runtime via
+// the control socket, letting operators move from e.g. 1 GiB shards to
+// 512 MiB shards without restarting the plugin.
+//
+// It's built lazily, on first use, rather than at package-init time:
+// newShardConfig reads DP_RESERVED_MEM_PER_GPU via getReservedMemPerGPU and
+// panics if it's unset or invalid, and package-level init runs before main()
+// (and before any go test setup), which would otherwise make that panic
+// unconditional for every binary that links this package.
+var (
+	shardsOnce sync.Once
+	shardsVal  *shardConfig
+)
+
+func shardConfigInstance() *shardConfig {
+	shardsOnce.Do(func() {
+		shardsVal = newShardConfig()
+	})
+	return shardsVal
+}
+
+type shardConfig struct {
+	mu              sync.RWMutex
+	shardUnitMiB    uint
+	reservedPercent uint
+	changed         chan struct{}
+}
+
+func newShardConfig() *shardConfig {
+	return &shardConfig{
+		shardUnitMiB:    1,
+		reservedPercent: getReservedMemPerGPU(),
+		changed:         make(chan struct{}),
+	}
+}
+
+// get returns the current shard unit size, in MiB, and the percentage of
+// each GPU's memory that is held back from allocation.
+func (s *shardConfig) get() (shardUnitMiB, reservedPercent uint) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shardUnitMiB, s.reservedPercent
+}
+
+func (s *shardConfig) set(shardUnitMiB, reservedPercent uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shardUnitMiB = shardUnitMiB
+	s.reservedPercent = reservedPercent
+	close(s.changed)
+	s.changed = make(chan struct{})
+	log.Printf("Shard configuration updated: shard unit=%d MiB, reserved=%d%%\n", shardUnitMiB, reservedPercent)
+}
+
+// Changed returns a channel that is closed the next time the shard
+// configuration is updated, so the plugin's serving loop can select on it to
+// know when to rebuild its device list and push a new ListAndWatch response.
+func (s *shardConfig) Changed() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changed
+}
+
+// ListenControlSocket serves shard configuration updates on a Unix socket at
+// DP_SHARD_CONTROL_SOCKET (or defaultShardControlSocket). Each connection is
+// expected to write a single JSON object, e.g.
+// {"shard_unit_mib":512,"reserved_percent":10}, and receives back
+// {"ok":true} or {"ok":false,"error":"..."}. Fields are optional; omitted
+// ones are left unchanged.
+func (s *shardConfig) ListenControlSocket(stop <-chan interface{}) error {
+	path := os.Getenv(envShardControlSocket)
+	if path == "" {
+		path = defaultShardControlSocket
+	}
+
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	go func() {
+		log.Printf("Listening for shard configuration updates on %s\n", path)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+type shardUpdateRequest struct {
+	ShardUnitMiB    *uint `json:"shard_unit_mib"`
+	ReservedPercent *uint `json:"reserved_percent"`
+}
+
+type shardUpdateResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (s *shardConfig) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req shardUpdateRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(shardUpdateResponse{Error: err.Error()})
+		return
+	}
+
+	shardUnitMiB, reservedPercent := s.get()
+	if req.ShardUnitMiB != nil {
+		if *req.ShardUnitMiB == 0 {
+			json.NewEncoder(conn).Encode(shardUpdateResponse{Error: "shard_unit_mib must be > 0"})
+			return
+		}
+		shardUnitMiB = *req.ShardUnitMiB
+	}
+	if req.ReservedPercent != nil {
+		if *req.ReservedPercent == 0 || *req.ReservedPercent > 100 {
+			json.NewEncoder(conn).Encode(shardUpdateResponse{Error: "reserved_percent must be in (0, 100]"})
+			return
+		}
+		reservedPercent = *req.ReservedPercent
+	}
+
+	s.set(shardUnitMiB, reservedPercent)
+	json.NewEncoder(conn).Encode(shardUpdateResponse{OK: true})
+}
+
+// shardTracker keeps the set of fake shard IDs currently allocated to
+// running pods, so that a shard resize never pulls a device out from under
+// a container: shrinking the shard count for a GPU only takes effect once
+// the pods holding its excess shards terminate and free them.
+//
+// MarkAllocated is called from NvidiaDevicePlugin.Allocate (server.go) as
+// soon as the kubelet hands a fake ID to a container. MarkFreed is called
+// from podResourcesReconciler (alloc_reconciler.go): the device plugin v1beta1
+// API has no "container terminated" callback, so freeing is detected by
+// polling the kubelet's PodResources API and noticing a previously-allocated
+// ID is no longer claimed by any pod.
+type shardTracker struct {
+	mu         sync.Mutex
+	allocated  map[string]bool
+	advertised map[string][]string // real device UUID -> currently advertised fake IDs
+}
+
+func newShardTracker() *shardTracker {
+	return &shardTracker{
+		allocated:  map[string]bool{},
+		advertised: map[string][]string{},
+	}
+}
+
+// MarkAllocated records that Allocate has handed fakeID to a container, so a
+// future shrink won't revoke it out from under that container.
+func (t *shardTracker) MarkAllocated(fakeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.allocated[fakeID] = true
+}
+
+// MarkFreed records that fakeID's owning pod has terminated, making it
+// eligible to disappear on the next shrink.
+func (t *shardTracker) MarkFreed(fakeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.allocated, fakeID)
+}
+
+// reconcile returns the fake IDs to advertise for realID: the desired set
+// from the current shard configuration, plus any previously-advertised IDs
+// that are still allocated.
+func (t *shardTracker) reconcile(realID string, desired []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	desiredSet := make(map[string]bool, len(desired))
+	for _, id := range desired {
+		desiredSet[id] = true
+	}
+
+	out := append([]string{}, desired...)
+	var keptPastShrink int
+	for _, id := range t.advertised[realID] {
+		if desiredSet[id] || !t.allocated[id] {
+			continue
+		}
+		out = append(out, id)
+		keptPastShrink++
+	}
+	if keptPastShrink > 0 {
+		log.Printf("Device=%s: keeping %d shard(s) that are still allocated past a shrink, until freed\n", realID, keptPastShrink)
+	}
+
+	t.advertised[realID] = out
+	return out
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// resetShardsForTest clears the shardConfigInstance singleton so a test can
+// observe a fresh newShardConfig() under its own env vars, independent of
+// whatever earlier test first triggered it.
+func resetShardsForTest() {
+	shardsOnce = sync.Once{}
+	shardsVal = nil
+}
+
+func TestShardConfigInstanceIsLazy(t *testing.T) {
+	t.Setenv(envReservedMemPerGPU, "10")
+	resetShardsForTest()
+
+	a := shardConfigInstance()
+	b := shardConfigInstance()
+	if a != b {
+		t.Errorf("shardConfigInstance() should return the same instance on every call")
+	}
+
+	_, reserved := a.get()
+	if reserved != 10 {
+		t.Errorf("reservedPercent = %d, want 10 (from %s)", reserved, envReservedMemPerGPU)
+	}
+}
+
+func TestShardConfigSetNotifiesChanged(t *testing.T) {
+	t.Setenv(envReservedMemPerGPU, "10")
+	s := newShardConfig()
+
+	changed := s.Changed()
+	select {
+	case <-changed:
+		t.Fatalf("Changed() channel should not be closed before set() is called")
+	default:
+	}
+
+	s.set(512, 20)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("Changed() channel should be closed after set()")
+	}
+
+	shardUnitMiB, reservedPercent := s.get()
+	if shardUnitMiB != 512 || reservedPercent != 20 {
+		t.Errorf("get() = (%d, %d), want (512, 20)", shardUnitMiB, reservedPercent)
+	}
+}
+
+func sortedStrings(ss []string) []string {
+	out := append([]string{}, ss...)
+	sort.Strings(out)
+	return out
+}
+
+func TestShardTrackerReconcileGrowsAndShrinks(t *testing.T) {
+	tr := newShardTracker()
+
+	got := tr.reconcile("gpu-0", []string{"gpu-0-_-0", "gpu-0-_-1"})
+	want := []string{"gpu-0-_-0", "gpu-0-_-1"}
+	if !reflect.DeepEqual(sortedStrings(got), want) {
+		t.Fatalf("reconcile(initial) = %v, want %v", got, want)
+	}
+
+	got = tr.reconcile("gpu-0", []string{"gpu-0-_-0"})
+	want = []string{"gpu-0-_-0"}
+	if !reflect.DeepEqual(sortedStrings(got), want) {
+		t.Fatalf("reconcile(shrink, nothing allocated) = %v, want %v", got, want)
+	}
+}
+
+func TestShardTrackerReconcileKeepsAllocatedShardsPastShrink(t *testing.T) {
+	tr := newShardTracker()
+
+	tr.reconcile("gpu-0", []string{"gpu-0-_-0", "gpu-0-_-1"})
+	tr.MarkAllocated("gpu-0-_-1")
+
+	got := sortedStrings(tr.reconcile("gpu-0", []string{"gpu-0-_-0"}))
+	want := []string{"gpu-0-_-0", "gpu-0-_-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reconcile(shrink, gpu-0-_-1 allocated) = %v, want %v (allocated shard must survive)", got, want)
+	}
+
+	tr.MarkFreed("gpu-0-_-1")
+	got = sortedStrings(tr.reconcile("gpu-0", []string{"gpu-0-_-0"}))
+	want = []string{"gpu-0-_-0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reconcile(after free) = %v, want %v (freed shard should now be dropped)", got, want)
+	}
+}
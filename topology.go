@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceTopology returns the pluginapi.TopologyInfo for d, so that the kubelet's
+// Topology Manager can co-locate GPU-sharing pods with CPUs/memory on the right
+// NUMA node(s). It starts from NVML's CPU affinity, resolved through sysfs to
+// the NUMA node(s) those CPUs actually belong to - which can be more than one
+// on boards that wire a GPU across sockets - and, when the device's PCI bus ID
+// is known, cross-checks /sys for any additional NUMA nodes the device's PCI
+// links span.
+func deviceTopology(d *nvmlDevice) *pluginapi.TopologyInfo {
+	nodes := map[int64]bool{}
+
+	for _, id := range d.NumaNodes {
+		nodes[id] = true
+	}
+
+	for _, id := range numaNodesFromSysfs(d) {
+		nodes[id] = true
+	}
+
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	topology := &pluginapi.TopologyInfo{}
+	for id := range nodes {
+		topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: id})
+	}
+	return topology
+}
+
+// numaNodesFromSysfs reads /sys/bus/pci/devices/<BDF>/numa_node for the device's
+// PCI bus ID, the same information `nvidia-smi topo -m` derives its NUMA affinity
+// column from. It returns no results (rather than erroring) when the PCI bus ID
+// isn't available or the host doesn't expose NUMA topology, since CPUAffinity
+// alone is enough to serve single-node hosts.
+func numaNodesFromSysfs(d *nvmlDevice) []int64 {
+	if d.PCIBusID == "" {
+		return nil
+	}
+
+	busID := strings.ToLower(d.PCIBusID)
+	path := filepath.Join("/sys/bus/pci/devices", busID, "numa_node")
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil || id < 0 {
+		return nil
+	}
+
+	log.Printf("Device %s: sysfs reports NUMA node %d for PCI bus %s\n", d.UUID, id, busID)
+	return []int64{id}
+}
+
+var (
+	cpuNodeOnce sync.Once
+	cpuNodeMap  map[int]int64
+)
+
+// cpuNUMANode returns the NUMA node sysfs reports logical CPU cpu as
+// belonging to. The scan of /sys/devices/system/node is cached on first use,
+// since the mapping never changes at runtime.
+func cpuNUMANode(cpu int) (int64, bool) {
+	cpuNodeOnce.Do(func() {
+		cpuNodeMap = scanCPUNodes("/sys/devices/system/node")
+	})
+	node, ok := cpuNodeMap[cpu]
+	return node, ok
+}
+
+// scanCPUNodes reads every nodeN/cpulist file under root and returns the
+// logical CPU -> NUMA node mapping they describe. It returns an empty map
+// (rather than erroring) on hosts that don't expose NUMA topology under
+// sysfs, e.g. single-node hosts or non-Linux platforms.
+func scanCPUNodes(root string) map[int]int64 {
+	out := map[int]int64{}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return out
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "node") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(name, "node"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(root, name, "cpulist"))
+		if err != nil {
+			continue
+		}
+		for _, cpu := range parseCPUList(strings.TrimSpace(string(raw))) {
+			out[cpu] = id
+		}
+	}
+
+	return out
+}
+
+// parseCPUList parses a Linux sysfs CPU list, e.g. "0-3,8,10-11", into the
+// individual CPU numbers it names.
+func parseCPUList(s string) []int {
+	var cpus []int
+	if s == "" {
+		return cpus
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// numaNodesFromAffinityMask resolves mask - an NVML CPU affinity bitmask
+// indexed by logical CPU number, not NUMA node number - to the distinct set
+// of NUMA nodes those CPUs belong to, via cpuNode. A single-socket host,
+// where every set CPU resolves to the same node, correctly collapses to one
+// node; a GPU wired across sockets yields more than one. CPUs that cpuNode
+// can't place (no NUMA info available) are skipped rather than guessed at.
+func numaNodesFromAffinityMask(mask uint64, cpuNode func(cpu int) (int64, bool)) []int64 {
+	seen := map[int64]bool{}
+	var nodes []int64
+	for cpu := 0; cpu < 64; cpu++ {
+		if mask&(1<<uint(cpu)) == 0 {
+			continue
+		}
+		node, ok := cpuNode(cpu)
+		if !ok || seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
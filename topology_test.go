@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []int
+	}{
+		{"", nil},
+		{"0", []int{0}},
+		{"0-3", []int{0, 1, 2, 3}},
+		{"0-3,8,10-11", []int{0, 1, 2, 3, 8, 10, 11}},
+	}
+	for _, c := range cases {
+		got := parseCPUList(c.in)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseCPUList(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestScanCPUNodes(t *testing.T) {
+	root := t.TempDir()
+	writeCPUList(t, root, "node0", "0-3")
+	writeCPUList(t, root, "node1", "4-7")
+
+	got := scanCPUNodes(root)
+	want := map[int]int64{0: 0, 1: 0, 2: 0, 3: 0, 4: 1, 5: 1, 6: 1, 7: 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanCPUNodes() = %v, want %v", got, want)
+	}
+}
+
+func writeCPUList(t *testing.T, root, node, cpulist string) {
+	t.Helper()
+	dir := filepath.Join(root, node)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cpulist"), []byte(cpulist+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumaNodesFromAffinityMaskSingleSocketCollapsesToOneNode(t *testing.T) {
+	// A single-socket host where every CPU in the mask belongs to node 0:
+	// bit-per-CPU decoding without NUMA resolution would have wrongly
+	// reported up to 8 "nodes" here.
+	allNodeZero := func(cpu int) (int64, bool) { return 0, true }
+
+	got := numaNodesFromAffinityMask(0xFF, allNodeZero)
+	want := []int64{0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("numaNodesFromAffinityMask(0xFF, single-socket) = %v, want %v", got, want)
+	}
+}
+
+func TestNumaNodesFromAffinityMaskSpansTwoSockets(t *testing.T) {
+	// CPUs 0-3 on node 0, CPUs 4-7 on node 1; a GPU with affinity to CPUs
+	// 0-7 genuinely spans both.
+	twoSocket := func(cpu int) (int64, bool) {
+		if cpu < 4 {
+			return 0, true
+		}
+		return 1, true
+	}
+
+	got := numaNodesFromAffinityMask(0xFF, twoSocket)
+	want := []int64{0, 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("numaNodesFromAffinityMask(0xFF, two-socket) = %v, want %v", got, want)
+	}
+}
+
+func TestNumaNodesFromAffinityMaskSkipsUnresolvableCPUs(t *testing.T) {
+	noInfo := func(cpu int) (int64, bool) { return 0, false }
+
+	got := numaNodesFromAffinityMask(0x3, noInfo)
+	if len(got) != 0 {
+		t.Errorf("numaNodesFromAffinityMask with no resolvable CPUs = %v, want empty", got)
+	}
+}
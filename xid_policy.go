@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envHealthcheckXids         = "DP_HEALTHCHECK_XIDS"
+	envHealthcheckFatalXids    = "DP_HEALTHCHECK_FATAL_XIDS"
+	envHealthcheckRecoverySecs = "DP_HEALTHCHECK_RECOVERY_SECONDS"
+)
+
+// defaultApplicationErrorXids are Xids that the NVIDIA Xid error table
+// documents as benign application errors: the GPU itself is still healthy.
+// See http://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
+var defaultApplicationErrorXids = []uint64{31, 43, 45}
+
+// xidPolicy decides, for a given Xid, whether a device should be left alone,
+// marked unhealthy, or (after recovering) restored to healthy.
+type xidPolicy struct {
+	// applicationErrorXids never mark a device unhealthy.
+	applicationErrorXids map[uint64]bool
+	// fatalXids, when non-empty, is the exclusive set of Xids that mark a
+	// device unhealthy; every other Xid not in applicationErrorXids is
+	// ignored. When empty, any Xid not in applicationErrorXids is fatal,
+	// matching the historical behavior of this plugin.
+	fatalXids map[uint64]bool
+	// recoveryCoolOff is how long a device must go without a further fatal
+	// Xid before it is offered back to ListAndWatch as healthy. Zero
+	// disables recovery, leaving devices unhealthy forever.
+	recoveryCoolOff time.Duration
+}
+
+// newXidPolicy builds an xidPolicy from DP_HEALTHCHECK_XIDS,
+// DP_HEALTHCHECK_FATAL_XIDS and DP_HEALTHCHECK_RECOVERY_SECONDS, falling back
+// to the plugin's historical Xid handling when they are unset.
+func newXidPolicy() *xidPolicy {
+	p := &xidPolicy{
+		applicationErrorXids: toXidSet(defaultApplicationErrorXids),
+		fatalXids:            map[uint64]bool{},
+	}
+
+	for _, xid := range parseXidList(envHealthcheckXids) {
+		p.applicationErrorXids[xid] = true
+	}
+	for _, xid := range parseXidList(envHealthcheckFatalXids) {
+		p.fatalXids[xid] = true
+	}
+
+	if raw := os.Getenv(envHealthcheckRecoverySecs); raw != "" {
+		secs, err := strconv.Atoi(raw)
+		if err != nil || secs < 0 {
+			log.Panicf("Fatal: invalid %s environment variable value: %v\n", envHealthcheckRecoverySecs, raw)
+		}
+		p.recoveryCoolOff = time.Duration(secs) * time.Second
+	}
+
+	return p
+}
+
+func (p *xidPolicy) isApplicationError(xid uint64) bool {
+	return p.applicationErrorXids[xid]
+}
+
+func (p *xidPolicy) isFatal(xid uint64) bool {
+	if p.isApplicationError(xid) {
+		return false
+	}
+	if len(p.fatalXids) == 0 {
+		return true
+	}
+	return p.fatalXids[xid]
+}
+
+func toXidSet(xids []uint64) map[uint64]bool {
+	set := make(map[uint64]bool, len(xids))
+	for _, xid := range xids {
+		set[xid] = true
+	}
+	return set
+}
+
+func parseXidList(env string) []uint64 {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return nil
+	}
+
+	var xids []uint64
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		xid, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			log.Panicf("Fatal: invalid Xid %q in %s environment variable: %v\n", f, env, err)
+		}
+		xids = append(xids, xid)
+	}
+	return xids
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2019, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "testing"
+
+func TestXidPolicyDefaults(t *testing.T) {
+	p := newXidPolicy()
+
+	if !p.isApplicationError(31) {
+		t.Errorf("Xid 31 should be a default application error")
+	}
+	if p.isFatal(31) {
+		t.Errorf("Xid 31 is a default application error and must never be fatal")
+	}
+	if !p.isFatal(79) {
+		t.Errorf("Xid 79 should be fatal under the default (no fatalXids set) policy")
+	}
+}
+
+func TestXidPolicyCustomApplicationErrors(t *testing.T) {
+	t.Setenv(envHealthcheckXids, "79, 94")
+	p := newXidPolicy()
+
+	if !p.isApplicationError(79) {
+		t.Errorf("Xid 79 should be treated as an application error once added via %s", envHealthcheckXids)
+	}
+	if p.isFatal(79) {
+		t.Errorf("Xid 79 must not be fatal once marked as an application error")
+	}
+}
+
+func TestXidPolicyFatalAllowList(t *testing.T) {
+	t.Setenv(envHealthcheckFatalXids, "48")
+	p := newXidPolicy()
+
+	if !p.isFatal(48) {
+		t.Errorf("Xid 48 should be fatal: it's in the %s allow list", envHealthcheckFatalXids)
+	}
+	if p.isFatal(79) {
+		t.Errorf("Xid 79 should be ignored once %s is set to a non-empty allow list", envHealthcheckFatalXids)
+	}
+}
+
+func TestXidPolicyRecoveryCoolOff(t *testing.T) {
+	p := newXidPolicy()
+	if p.recoveryCoolOff != 0 {
+		t.Errorf("recoveryCoolOff should default to 0 (recovery disabled), got %s", p.recoveryCoolOff)
+	}
+
+	t.Setenv(envHealthcheckRecoverySecs, "30")
+	p = newXidPolicy()
+	if p.recoveryCoolOff.Seconds() != 30 {
+		t.Errorf("recoveryCoolOff = %s, want 30s", p.recoveryCoolOff)
+	}
+}